@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxBatchKeys bounds how many keys a single :mget/:mset/:mdel request may
+// carry, since the whole envelope is decoded into memory up front.
+const maxBatchKeys = 1000
+
+// batchKeysRequest is the envelope for :mget and :mdel.
+type batchKeysRequest struct {
+	Keys []string `json:"keys" msgpack:"keys"`
+}
+
+// batchSetRequest is the envelope for :mset.
+type batchSetRequest struct {
+	Items []batchSetItem `json:"items" msgpack:"items"`
+}
+
+type batchSetItem struct {
+	Key   string `json:"key" msgpack:"key"`
+	Value []byte `json:"value" msgpack:"value"`
+}
+
+// batchResult reports the outcome for one key, in the same position it was
+// requested in, so callers can zip the response back up against their
+// input without needing a map.
+type batchResult struct {
+	Key    string `json:"key" msgpack:"key"`
+	Status int    `json:"status" msgpack:"status"`
+	Value  []byte `json:"value,omitempty" msgpack:"value,omitempty"`
+	Error  string `json:"error,omitempty" msgpack:"error,omitempty"`
+}
+
+func decodeBatchBody(req *http.Request, v interface{}) error {
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "application/msgpack" {
+		return msgpack.NewDecoder(req.Body).Decode(v)
+	}
+	return json.NewDecoder(req.Body).Decode(v)
+}
+
+func encodeBatchResponse(w http.ResponseWriter, req *http.Request, v interface{}) error {
+	if acceptsMsgpack(req) {
+		w.Header().Set("Content-Type", "application/msgpack")
+		return msgpack.NewEncoder(w).Encode(v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+func acceptsMsgpack(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == "application/msgpack" {
+			return true
+		}
+	}
+	return false
+}
+
+// groupByShard buckets key indices by a hash of the key mod shardCount, so
+// each bucket can be processed by its own goroutine without two goroutines
+// ever touching the same shard at once. This mirrors bigcache's own
+// sharding without needing access to its unexported hash function.
+func groupByShard(keys []string, shardCount int) map[int][]int {
+	if shardCount <= 0 {
+		shardCount = 1
+	}
+
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		shard := int(h.Sum64() % uint64(shardCount))
+		groups[shard] = append(groups[shard], i)
+	}
+	return groups
+}
+
+func validateBatchSize(n int) error {
+	if n == 0 {
+		return fmt.Errorf("request must contain at least one key")
+	}
+	if n > maxBatchKeys {
+		return fmt.Errorf("request contains %d keys, which exceeds the limit of %d", n, maxBatchKeys)
+	}
+	return nil
+}
+
+// batchGetHandler serves POST /api/v1/cache:mget. Keys are grouped by
+// shard and fetched concurrently, one goroutine per shard, so the request
+// cost is bounded by the slowest shard rather than the number of keys.
+// It goes through fetchEntry, which resolves keys with contentReaderFor just
+// as getCacheHandler does, so a key written through the chunked-upload
+// protocol is reassembled here too.
+func batchGetHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var batch batchKeysRequest
+	if err := decodeBatchBody(req, &batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateBatchSize(len(batch.Keys)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchResult, len(batch.Keys))
+	var g errgroup.Group
+	for _, indices := range groupByShard(batch.Keys, *shards) {
+		indices := indices
+		g.Go(func() error {
+			for _, i := range indices {
+				key := batch.Keys[i]
+				content, _, err := fetchEntry(key)
+				if err != nil {
+					results[i] = batchResult{Key: key, Status: http.StatusNotFound, Error: err.Error()}
+					continue
+				}
+				value, err := ioutil.ReadAll(content)
+				if err != nil {
+					results[i] = batchResult{Key: key, Status: http.StatusInternalServerError, Error: err.Error()}
+					continue
+				}
+				results[i] = batchResult{Key: key, Status: http.StatusOK, Value: value}
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	if err := encodeBatchResponse(w, req, results); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// batchSetHandler serves POST /api/v1/cache:mset. It goes through
+// storeEntry, the same helper putCacheHandler uses, so batch-set keys get
+// the same ETag/Last-Modified record an individual PUT would.
+func batchSetHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var batch batchSetRequest
+	if err := decodeBatchBody(req, &batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateBatchSize(len(batch.Items)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys := make([]string, len(batch.Items))
+	for i, item := range batch.Items {
+		keys[i] = item.Key
+	}
+
+	results := make([]batchResult, len(batch.Items))
+	var g errgroup.Group
+	for _, indices := range groupByShard(keys, *shards) {
+		indices := indices
+		g.Go(func() error {
+			for _, i := range indices {
+				item := batch.Items[i]
+				if err := storeEntry(item.Key, item.Value); err != nil {
+					results[i] = batchResult{Key: item.Key, Status: http.StatusInternalServerError, Error: err.Error()}
+					continue
+				}
+				results[i] = batchResult{Key: item.Key, Status: http.StatusCreated}
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	if err := encodeBatchResponse(w, req, results); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// batchDeleteHandler serves POST /api/v1/cache:mdel. It goes through
+// removeEntry, the same helper deleteCacheHandler uses, so batch-deleting
+// a chunked entry also cleans up its sub-chunks and chunk index.
+func batchDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var batch batchKeysRequest
+	if err := decodeBatchBody(req, &batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateBatchSize(len(batch.Keys)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchResult, len(batch.Keys))
+	var g errgroup.Group
+	for _, indices := range groupByShard(batch.Keys, *shards) {
+		indices := indices
+		g.Go(func() error {
+			for _, i := range indices {
+				key := batch.Keys[i]
+				if err := removeEntry(key); err != nil {
+					results[i] = batchResult{Key: key, Status: http.StatusNotFound, Error: err.Error()}
+					continue
+				}
+				results[i] = batchResult{Key: key, Status: http.StatusOK}
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	if err := encodeBatchResponse(w, req, results); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBatchSetGetDelete(t *testing.T) {
+	t.Parallel()
+
+	setBody, err := json.Marshal(batchSetRequest{Items: []batchSetItem{
+		{Key: "batchKey1", Value: []byte("one")},
+		{Key: "batchKey2", Value: []byte("two")},
+	}})
+	if err != nil {
+		t.Fatalf("marshal set request: %s", err)
+	}
+
+	setReq := httptest.NewRequest("POST", testBaseString+"/api/v1/cache:mset", bytes.NewReader(setBody))
+	setRR := httptest.NewRecorder()
+	batchSetHandler(setRR, setReq)
+
+	var setResults []batchResult
+	if err := json.NewDecoder(setRR.Result().Body).Decode(&setResults); err != nil {
+		t.Fatalf("decode set response: %s", err)
+	}
+	for _, result := range setResults {
+		if result.Status != 201 {
+			t.Errorf("want: 201; got: %d for key %s", result.Status, result.Key)
+		}
+	}
+
+	// A batch-set key must get the same ETag/Last-Modified record an
+	// individual PUT would, so a subsequent conditional GET can 304.
+	if _, err := metaCache.Get("batchKey1"); err != nil {
+		t.Errorf("want: meta recorded for batch-set key; got: %s", err)
+	}
+
+	getBody, err := json.Marshal(batchKeysRequest{Keys: []string{"batchKey1", "batchKey2", "doesNotExist"}})
+	if err != nil {
+		t.Fatalf("marshal get request: %s", err)
+	}
+	getReq := httptest.NewRequest("POST", testBaseString+"/api/v1/cache:mget", bytes.NewReader(getBody))
+	getRR := httptest.NewRecorder()
+	batchGetHandler(getRR, getReq)
+
+	var getResults []batchResult
+	if err := json.NewDecoder(getRR.Result().Body).Decode(&getResults); err != nil {
+		t.Fatalf("decode get response: %s", err)
+	}
+	if len(getResults) != 3 {
+		t.Fatalf("want: 3 results; got: %d", len(getResults))
+	}
+	byKey := make(map[string]batchResult, len(getResults))
+	for _, result := range getResults {
+		byKey[result.Key] = result
+	}
+	if string(byKey["batchKey1"].Value) != "one" || byKey["batchKey1"].Status != 200 {
+		t.Errorf("want: one/200; got: %s/%d", byKey["batchKey1"].Value, byKey["batchKey1"].Status)
+	}
+	if string(byKey["batchKey2"].Value) != "two" || byKey["batchKey2"].Status != 200 {
+		t.Errorf("want: two/200; got: %s/%d", byKey["batchKey2"].Value, byKey["batchKey2"].Status)
+	}
+	if byKey["doesNotExist"].Status != 404 {
+		t.Errorf("want: 404; got: %d", byKey["doesNotExist"].Status)
+	}
+
+	delBody, err := json.Marshal(batchKeysRequest{Keys: []string{"batchKey1", "batchKey2"}})
+	if err != nil {
+		t.Fatalf("marshal delete request: %s", err)
+	}
+	delReq := httptest.NewRequest("POST", testBaseString+"/api/v1/cache:mdel", bytes.NewReader(delBody))
+	delRR := httptest.NewRecorder()
+	batchDeleteHandler(delRR, delReq)
+
+	var delResults []batchResult
+	if err := json.NewDecoder(delRR.Result().Body).Decode(&delResults); err != nil {
+		t.Fatalf("decode delete response: %s", err)
+	}
+	for _, result := range delResults {
+		if result.Status != 200 {
+			t.Errorf("want: 200; got: %d for key %s", result.Status, result.Key)
+		}
+	}
+
+	if _, err := cache.Get("batchKey1"); err == nil {
+		t.Error("want: batchKey1 deleted; got: still present")
+	}
+}
+
+// TestBatchGetReassemblesChunkedEntry guards against :mget diverging from
+// GET /api/v1/cache/<key> for entries written through the resumable
+// upload protocol.
+func TestBatchGetReassemblesChunkedEntry(t *testing.T) {
+	t.Parallel()
+	testHandlers := cacheIndexHandler()
+
+	startReq := httptest.NewRequest("POST", testBaseString+"/api/v1/cache/batchChunkedKey/uploads", nil)
+	startRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(startRR, startReq)
+	location := startRR.Result().Header.Get("Location")
+
+	patchReq := httptest.NewRequest("PATCH", testBaseString+location, bytes.NewBuffer([]byte("chunked batch value")))
+	patchRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(patchRR, patchReq)
+
+	finishReq := httptest.NewRequest("PUT", testBaseString+location, nil)
+	finishRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(finishRR, finishReq)
+	if finishRR.Result().StatusCode != 201 {
+		t.Fatalf("want: 201; got: %d.\n\tcan't finish an upload.", finishRR.Result().StatusCode)
+	}
+
+	getBody, err := json.Marshal(batchKeysRequest{Keys: []string{"batchChunkedKey"}})
+	if err != nil {
+		t.Fatalf("marshal get request: %s", err)
+	}
+	getReq := httptest.NewRequest("POST", testBaseString+"/api/v1/cache:mget", bytes.NewReader(getBody))
+	getRR := httptest.NewRecorder()
+	batchGetHandler(getRR, getReq)
+
+	var results []batchResult
+	if err := json.NewDecoder(getRR.Result().Body).Decode(&results); err != nil {
+		t.Fatalf("decode get response: %s", err)
+	}
+	if len(results) != 1 || results[0].Status != 200 {
+		t.Fatalf("want: 1 result at 200; got: %+v", results)
+	}
+	if string(results[0].Value) != "chunked batch value" {
+		t.Errorf("want: chunked batch value; got: %s", results[0].Value)
+	}
+}
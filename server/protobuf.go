@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+// protobufCodec implements application/x-protobuf for the small messages
+// this package needs, using a minimal hand-written varint/length-delimited
+// encoder instead of pulling in protoc-generated code for two message
+// shapes. The wire format matches what the following .proto would produce:
+//
+//	message CacheEntry {
+//	  string key    = 1;
+//	  bytes  value  = 2;
+//	  int64  expiry = 3;
+//	  string etag   = 4;
+//	}
+//
+//	message Stats {
+//	  int64 hits       = 1;
+//	  int64 misses     = 2;
+//	  int64 del_hits   = 3;
+//	  int64 del_misses = 4;
+//	  int64 collisions = 5;
+//	}
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) EncodeEntry(w io.Writer, entry CacheEntry) error {
+	var buf []byte
+	buf = appendTagString(buf, 1, entry.Key)
+	buf = appendTagBytes(buf, 2, entry.Value)
+	buf = appendTagVarint(buf, 3, uint64(entry.Expiry))
+	buf = appendTagString(buf, 4, entry.ETag)
+	_, err := w.Write(buf)
+	return err
+}
+
+func (protobufCodec) DecodeEntry(r io.Reader) (CacheEntry, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+
+	var entry CacheEntry
+	for len(raw) > 0 {
+		field, wireType, n, err := readTag(raw)
+		if err != nil {
+			return CacheEntry{}, err
+		}
+		raw = raw[n:]
+
+		switch wireType {
+		case 0:
+			v, n, err := readVarint(raw)
+			if err != nil {
+				return CacheEntry{}, err
+			}
+			raw = raw[n:]
+			if field == 3 {
+				entry.Expiry = int64(v)
+			}
+		case 2:
+			data, n, err := readLengthDelimited(raw)
+			if err != nil {
+				return CacheEntry{}, err
+			}
+			raw = raw[n:]
+			switch field {
+			case 1:
+				entry.Key = string(data)
+			case 2:
+				entry.Value = append([]byte(nil), data...)
+			case 4:
+				entry.ETag = string(data)
+			}
+		default:
+			return CacheEntry{}, fmt.Errorf("protobuf: unsupported wire type %d for field %d", wireType, field)
+		}
+	}
+	return entry, nil
+}
+
+func (protobufCodec) EncodeStats(w io.Writer, stats bigcache.Stats) error {
+	var buf []byte
+	buf = appendTagVarint(buf, 1, uint64(stats.Hits))
+	buf = appendTagVarint(buf, 2, uint64(stats.Misses))
+	buf = appendTagVarint(buf, 3, uint64(stats.DelHits))
+	buf = appendTagVarint(buf, 4, uint64(stats.DelMisses))
+	buf = appendTagVarint(buf, 5, uint64(stats.Collisions))
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendTagVarint(buf []byte, field int, v uint64) []byte {
+	buf = appendVarint(buf, uint64(field)<<3)
+	return appendVarint(buf, v)
+}
+
+func appendTagBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|2)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendTagString(buf []byte, field int, s string) []byte {
+	return appendTagBytes(buf, field, []byte(s))
+}
+
+func readVarint(data []byte) (v uint64, n int, err error) {
+	var shift uint
+	for i, b := range data {
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, i + 1, nil
+		}
+		shift += 7
+		if shift >= 64 {
+			return 0, 0, errors.New("protobuf: varint overflow")
+		}
+	}
+	return 0, 0, errors.New("protobuf: truncated varint")
+}
+
+func readTag(data []byte) (field, wireType, n int, err error) {
+	v, n, err := readVarint(data)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return int(v >> 3), int(v & 0x7), n, nil
+}
+
+func readLengthDelimited(data []byte) (value []byte, n int, err error) {
+	length, n, err := readVarint(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	data = data[n:]
+	if length > uint64(len(data)) {
+		return nil, 0, errors.New("protobuf: truncated length-delimited field")
+	}
+	return data[:length], n + int(length), nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+const (
+	apiV1CachePrefix = "/api/v1/cache/"
+	apiV1StatsPath   = "/api/v1/stats"
+)
+
+var (
+	cache *bigcache.BigCache
+	// metaCache holds the validators (ETag/Last-Modified) for entries stored
+	// in cache, keyed by the same user key, so conditional requests can be
+	// answered without touching the value shard.
+	metaCache *bigcache.BigCache
+	// chunkIndexCache holds the chunk layout for entries that were uploaded
+	// through the resumable upload protocol, keyed by the same user key.
+	chunkIndexCache *bigcache.BigCache
+
+	port               = flag.Int("p", 9090, "Port to listen on")
+	shards             = flag.Int("shards", 1024, "Number of shards for the cache")
+	lifeWindowSeconds  = flag.Int("lifeWindow", 600, "Number of seconds after which entry can be evicted")
+	maxEntriesInWindow = flag.Int("maxEntriesInWindow", 1000*10*60, "Used only to calculate initial size for cache shards")
+	maxEntrySize       = flag.Int("maxEntrySize", 500, "Used only to calculate initial size for cache shards")
+	verbose            = flag.Bool("verbose", true, "Whether print logs about cache behaviour")
+	hardMaxCacheSize   = flag.Int("hardMaxCacheSize", 8192, "Cache will not allocate more memory than this limit, value in MB")
+)
+
+func keyFromRequest(req *http.Request) string {
+	return strings.TrimPrefix(req.URL.Path, apiV1CachePrefix)
+}
+
+// entryMeta is the validator pair handed out for a cached entry so that
+// conditional GETs can be answered without re-reading the value.
+type entryMeta struct {
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+func etagFor(value []byte) string {
+	sum := sha256.Sum256(value)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func setMeta(key string, value []byte) error {
+	return setMetaWithETag(key, etagFor(value))
+}
+
+func setMetaWithETag(key, etag string) error {
+	meta := entryMeta{ETag: etag, LastModified: time.Now()}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return metaCache.Set(key, raw)
+}
+
+// metaFor returns the stored validators for key, falling back to validators
+// computed from content if none were recorded (e.g. the entry predates this
+// feature, or the meta shard evicted it independently of the value shard).
+// content is left seeked back to the start in either case.
+func metaFor(key string, content io.ReadSeeker) (entryMeta, error) {
+	if raw, err := metaCache.Get(key); err == nil {
+		var meta entryMeta
+		if err := json.Unmarshal(raw, &meta); err == nil {
+			return meta, nil
+		}
+	}
+
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return entryMeta{}, err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return entryMeta{}, err
+	}
+	return entryMeta{ETag: etagFor(data), LastModified: time.Now()}, nil
+}
+
+// cacheControlDirectives parses a Cache-Control header into a directive ->
+// value map; directives without a value (e.g. "no-cache") map to "".
+func cacheControlDirectives(req *http.Request) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(req.Header.Get("Cache-Control"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if idx := strings.IndexByte(part, '='); idx >= 0 {
+			directives[part[:idx]] = strings.Trim(part[idx+1:], `"`)
+		} else {
+			directives[part] = ""
+		}
+	}
+	return directives
+}
+
+// isWithinMaxStale reports whether staleness (the amount by which an entry
+// has exceeded max-age) falls inside the "max-stale=<seconds>" budget a
+// client offered. A malformed value is treated as not satisfied, since we
+// can't tell what the client actually bounded it to.
+func isWithinMaxStale(maxStaleSeconds string, staleness time.Duration) bool {
+	maxStale, err := strconv.Atoi(maxStaleSeconds)
+	return err == nil && staleness <= time.Duration(maxStale)*time.Second
+}
+
+// getCacheHandler serves GET /api/v1/cache/<key>. It delegates conditional
+// ("If-None-Match"/"If-Modified-Since") and Range handling to
+// http.ServeContent, which also emits Content-Range/Accept-Ranges and 206
+// responses for free once the ETag and modification time are set.
+func getCacheHandler(w http.ResponseWriter, req *http.Request) {
+	key := keyFromRequest(req)
+	if key == "" {
+		http.Error(w, "key is empty", http.StatusBadRequest)
+		return
+	}
+
+	directives := cacheControlDirectives(req)
+
+	content, err := contentReaderFor(key)
+	if _, onlyIfCached := directives["only-if-cached"]; onlyIfCached && err != nil {
+		http.Error(w, "key is not in cache", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	meta, err := metaFor(key, content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Per RFC 7234, a cache must not return a stale response without
+	// revalidation unless the client opted into exactly that via
+	// "max-stale" — its absence is not itself a reason to relax anything.
+	maxAge := time.Duration(*lifeWindowSeconds) * time.Second
+	if age := time.Since(meta.LastModified); age > maxAge {
+		staleRaw, hasMaxStale := directives["max-stale"]
+		withinMaxStale := hasMaxStale && (staleRaw == "" || isWithinMaxStale(staleRaw, age-maxAge))
+		if !withinMaxStale {
+			http.Error(w, "entry is stale", http.StatusGatewayTimeout)
+			return
+		}
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+
+	if codec := negotiatedEntryCodec(req); codec != nil {
+		serveEntry(w, req, codec, key, meta, content)
+		return
+	}
+
+	w.Header().Set("ETag", meta.ETag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", *lifeWindowSeconds))
+
+	if _, noCache := directives["no-cache"]; noCache {
+		// The client wants the cache to revalidate rather than answer from
+		// the conditional shortcut, so strip the headers ServeContent would
+		// otherwise use to short-circuit with a 304.
+		clone := req.Clone(req.Context())
+		clone.Header.Del("If-None-Match")
+		clone.Header.Del("If-Modified-Since")
+		req = clone
+	}
+
+	http.ServeContent(w, req, key, meta.LastModified, content)
+}
+
+// serveEntry answers a GET with a typed CacheEntry encoded in a negotiated
+// wire format instead of the raw value, for clients that asked for one via
+// Accept. This bypasses the Range machinery above: a typed envelope is a
+// different representation of the whole resource, not a byte range of it.
+// It still honors If-None-Match against meta.ETag, since that's cheap to
+// check regardless of representation and typed clients benefit from it too.
+func serveEntry(w http.ResponseWriter, req *http.Request, codec Codec, key string, meta entryMeta, content io.ReadSeeker) {
+	w.Header().Set("ETag", meta.ETag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", *lifeWindowSeconds))
+
+	if etagMatches(req.Header.Get("If-None-Match"), meta.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	value, err := ioutil.ReadAll(content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entry := CacheEntry{
+		Key:    key,
+		Value:  value,
+		Expiry: meta.LastModified.Add(time.Duration(*lifeWindowSeconds) * time.Second).Unix(),
+		ETag:   meta.ETag,
+	}
+
+	w.Header().Set("Content-Type", codec.ContentType())
+	if err := codec.EncodeEntry(w, entry); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// etagMatches reports whether etag appears in an If-None-Match header
+// value, which may be "*" or a comma-separated list of quoted ETags.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if ifNoneMatch == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// readPutValue reads the request body as a raw value, or — if Content-Type
+// names one of the registered codecs — decodes it as a CacheEntry and
+// returns its Value field, so typed clients can PUT without hand-rolling
+// the raw-bytes convention themselves.
+func readPutValue(req *http.Request) ([]byte, error) {
+	if codec := codecFor(req.Header.Get("Content-Type")); codec != nil {
+		entry, err := codec.DecodeEntry(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		return entry.Value, nil
+	}
+	return ioutil.ReadAll(req.Body)
+}
+
+// fetchEntry resolves key to a seekable reader over its value, reassembling
+// a chunked-upload entry transparently, plus its cached validators. It's
+// the read path for the :mget batch endpoint, and does the same
+// contentReaderFor/metaFor lookup that getCacheHandler does inline.
+func fetchEntry(key string) (io.ReadSeeker, entryMeta, error) {
+	content, err := contentReaderFor(key)
+	if err != nil {
+		return nil, entryMeta{}, err
+	}
+	meta, err := metaFor(key, content)
+	if err != nil {
+		return nil, entryMeta{}, err
+	}
+	return content, meta, nil
+}
+
+// storeEntry writes value under key and records its validators. It's the
+// shared write path for putCacheHandler and the :mset batch endpoint.
+func storeEntry(key string, value []byte) error {
+	if err := setValue(key, value); err != nil {
+		return err
+	}
+	return setMeta(key, value)
+}
+
+// removeEntry deletes key, cleaning up its chunk sub-keys and chunk index
+// if it was written through the resumable upload protocol, and its meta
+// record. It's the shared delete path for deleteCacheHandler and the
+// :mdel batch endpoint.
+func removeEntry(key string) error {
+	deleteErr := deleteValue(key)
+
+	if raw, err := chunkIndexCache.Get(key); err == nil {
+		var index chunkIndex
+		if err := json.Unmarshal(raw, &index); err == nil {
+			for i := 0; i < index.ChunkCount; i++ {
+				_ = cache.Delete(chunkKey(key, i))
+			}
+			deleteErr = nil
+		}
+		_ = chunkIndexCache.Delete(key)
+	}
+
+	if deleteErr != nil {
+		return deleteErr
+	}
+
+	// Best-effort: the meta entry may already be gone or may never have
+	// existed (pre-ETag entries), neither of which is an error for DELETE.
+	_ = metaCache.Delete(key)
+	return nil
+}
+
+func putCacheHandler(w http.ResponseWriter, req *http.Request) {
+	key := keyFromRequest(req)
+	if key == "" {
+		http.Error(w, "key is empty", http.StatusBadRequest)
+		return
+	}
+
+	value, err := readPutValue(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := storeEntry(key, value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func deleteCacheHandler(w http.ResponseWriter, req *http.Request) {
+	key := keyFromRequest(req)
+	if key == "" {
+		http.Error(w, "key is empty", http.StatusNotFound)
+		return
+	}
+
+	if err := removeEntry(key); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+}
+
+func cacheIndexHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if key, id, ok := parseUploadPath(req.URL.Path); ok && isUploadRequest(req.Method, id) {
+			uploadIndexHandler(w, req, key, id)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			getCacheHandler(w, req)
+		case http.MethodPut:
+			putCacheHandler(w, req)
+		case http.MethodDelete:
+			deleteCacheHandler(w, req)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func getCacheStatsHandler(w http.ResponseWriter, req *http.Request) {
+	codec := negotiateStatsCodec(req)
+	stats := cache.Stats()
+
+	w.Header().Set("Content-Type", codec.ContentType())
+	if err := codec.EncodeStats(w, stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func statsIndexHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			getCacheStatsHandler(w, req)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func main() {
+	flag.Parse()
+
+	config := bigcache.Config{
+		Shards:             *shards,
+		LifeWindow:         time.Duration(*lifeWindowSeconds) * time.Second,
+		MaxEntriesInWindow: *maxEntriesInWindow,
+		MaxEntrySize:       *maxEntrySize,
+		Verbose:            *verbose,
+		HardMaxCacheSize:   *hardMaxCacheSize,
+		OnRemove:           nil,
+	}
+
+	var err error
+	cache, err = bigcache.New(context.Background(), config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	metaCache, err = bigcache.New(context.Background(), config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	chunkIndexCache, err = bigcache.New(context.Background(), config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupTier(config); err != nil {
+		log.Fatal(err)
+	}
+
+	go runUploadReaper()
+
+	http.Handle(apiV1CachePrefix, cacheIndexHandler())
+	http.Handle(apiV1StatsPath, statsIndexHandler())
+	http.HandleFunc("/api/v1/cache:mget", batchGetHandler)
+	http.HandleFunc("/api/v1/cache:mset", batchSetHandler)
+	http.HandleFunc("/api/v1/cache:mdel", batchDeleteHandler)
+
+	log.Printf("server listening on port %d", *port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+}
@@ -7,6 +7,9 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,7 +21,7 @@ const (
 )
 
 func testCacheSetup() {
-	cache, _ = bigcache.New(context.Background(), bigcache.Config{
+	config := bigcache.Config{
 		Shards:             1024,
 		LifeWindow:         10 * time.Minute,
 		MaxEntriesInWindow: 1000 * 10 * 60,
@@ -26,7 +29,10 @@ func testCacheSetup() {
 		Verbose:            true,
 		HardMaxCacheSize:   8192,
 		OnRemove:           nil,
-	})
+	}
+	cache, _ = bigcache.New(context.Background(), config)
+	metaCache, _ = bigcache.New(context.Background(), config)
+	chunkIndexCache, _ = bigcache.New(context.Background(), config)
 }
 
 func TestMain(m *testing.M) {
@@ -158,6 +164,176 @@ func TestDeleteKey(t *testing.T) {
 	}
 }
 
+func TestGetKeyConditional(t *testing.T) {
+	t.Parallel()
+
+	putReq := httptest.NewRequest("PUT", testBaseString+"/api/v1/cache/conditionalKey", bytes.NewBuffer([]byte("123")))
+	putRR := httptest.NewRecorder()
+	putCacheHandler(putRR, putReq)
+	if putRR.Result().StatusCode != 201 {
+		t.Fatalf("want: 201; got: %d", putRR.Result().StatusCode)
+	}
+
+	firstReq := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/conditionalKey", nil)
+	firstRR := httptest.NewRecorder()
+	getCacheHandler(firstRR, firstReq)
+	firstResp := firstRR.Result()
+	if firstResp.StatusCode != 200 {
+		t.Fatalf("want: 200; got: %d", firstResp.StatusCode)
+	}
+	etag := firstResp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("want non-empty ETag")
+	}
+
+	matchReq := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/conditionalKey", nil)
+	matchReq.Header.Set("If-None-Match", etag)
+	matchRR := httptest.NewRecorder()
+	getCacheHandler(matchRR, matchReq)
+	if matchRR.Result().StatusCode != 304 {
+		t.Errorf("want: 304; got: %d.\n\tmatching If-None-Match should 304.", matchRR.Result().StatusCode)
+	}
+
+	mismatchReq := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/conditionalKey", nil)
+	mismatchReq.Header.Set("If-None-Match", `"does-not-match"`)
+	mismatchRR := httptest.NewRecorder()
+	getCacheHandler(mismatchRR, mismatchReq)
+	if mismatchRR.Result().StatusCode != 200 {
+		t.Errorf("want: 200; got: %d.\n\tmismatched If-None-Match should serve the body.", mismatchRR.Result().StatusCode)
+	}
+}
+
+func TestGetKeyRange(t *testing.T) {
+	t.Parallel()
+
+	putReq := httptest.NewRequest("PUT", testBaseString+"/api/v1/cache/rangeKey", bytes.NewBuffer([]byte("0123456789")))
+	putRR := httptest.NewRecorder()
+	putCacheHandler(putRR, putReq)
+	if putRR.Result().StatusCode != 201 {
+		t.Fatalf("want: 201; got: %d", putRR.Result().StatusCode)
+	}
+
+	rangeReq := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/rangeKey", nil)
+	rangeReq.Header.Set("Range", "bytes=2-5")
+	rangeRR := httptest.NewRecorder()
+	getCacheHandler(rangeRR, rangeReq)
+	rangeResp := rangeRR.Result()
+	if rangeResp.StatusCode != 206 {
+		t.Fatalf("want: 206; got: %d", rangeResp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(rangeResp.Body)
+	if err != nil {
+		t.Fatalf("cannot deserialise test response: %s", err)
+	}
+	if string(body) != "2345" {
+		t.Errorf("want: 2345; got: %s.\n\tRange: bytes=2-5 should return the 4 bytes it spans.", string(body))
+	}
+	if cr := rangeResp.Header.Get("Content-Range"); cr != "bytes 2-5/10" {
+		t.Errorf("want: bytes 2-5/10; got: %s", cr)
+	}
+}
+
+// putStaleKey stores key/value normally, then overwrites its meta record
+// so LastModified looks staleBy older than *lifeWindowSeconds allows.
+func putStaleKey(t *testing.T, key string, value []byte, staleBy time.Duration) {
+	t.Helper()
+	if err := cache.Set(key, value); err != nil {
+		t.Fatalf("can't set key for testing: %s", err)
+	}
+	maxAge := time.Duration(*lifeWindowSeconds) * time.Second
+	meta := entryMeta{ETag: etagFor(value), LastModified: time.Now().Add(-(maxAge + staleBy))}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatalf("can't marshal meta for testing: %s", err)
+	}
+	if err := metaCache.Set(key, raw); err != nil {
+		t.Fatalf("can't set meta for testing: %s", err)
+	}
+}
+
+func TestGetKeyStaleRejectedByDefault(t *testing.T) {
+	t.Parallel()
+	putStaleKey(t, "staleKey", []byte("old"), 10*time.Second)
+
+	req := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/staleKey", nil)
+	rr := httptest.NewRecorder()
+	getCacheHandler(rr, req)
+	if rr.Result().StatusCode != 504 {
+		t.Errorf("want: 504; got: %d.\n\ta stale entry with no Cache-Control should be rejected, not served.", rr.Result().StatusCode)
+	}
+}
+
+func TestGetKeyMaxStaleWithinBound(t *testing.T) {
+	t.Parallel()
+	putStaleKey(t, "maxStaleWithinKey", []byte("old"), 5*time.Second)
+
+	req := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/maxStaleWithinKey", nil)
+	req.Header.Set("Cache-Control", "max-stale=30")
+	rr := httptest.NewRecorder()
+	getCacheHandler(rr, req)
+	resp := rr.Result()
+	if resp.StatusCode != 200 {
+		t.Fatalf("want: 200; got: %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Warning") == "" {
+		t.Error("want non-empty Warning header for a stale-but-within-max-stale response")
+	}
+}
+
+func TestGetKeyMaxStaleExceeded(t *testing.T) {
+	t.Parallel()
+	putStaleKey(t, "maxStaleExceededKey", []byte("old"), 120*time.Second)
+
+	req := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/maxStaleExceededKey", nil)
+	req.Header.Set("Cache-Control", "max-stale=30")
+	rr := httptest.NewRecorder()
+	getCacheHandler(rr, req)
+	if rr.Result().StatusCode != 504 {
+		t.Errorf("want: 504; got: %d.\n\tstaleness beyond the max-stale budget should still be rejected.", rr.Result().StatusCode)
+	}
+}
+
+func TestGetKeyOnlyIfCachedMiss(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/onlyIfCachedMissKey", nil)
+	req.Header.Set("Cache-Control", "only-if-cached")
+	rr := httptest.NewRecorder()
+	getCacheHandler(rr, req)
+	if rr.Result().StatusCode != 504 {
+		t.Errorf("want: 504; got: %d", rr.Result().StatusCode)
+	}
+}
+
+func TestGetKeyNoCacheForcesRevalidation(t *testing.T) {
+	t.Parallel()
+
+	putReq := httptest.NewRequest("PUT", testBaseString+"/api/v1/cache/noCacheKey", bytes.NewBuffer([]byte("123")))
+	putRR := httptest.NewRecorder()
+	putCacheHandler(putRR, putReq)
+	if putRR.Result().StatusCode != 201 {
+		t.Fatalf("want: 201; got: %d", putRR.Result().StatusCode)
+	}
+
+	firstReq := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/noCacheKey", nil)
+	firstRR := httptest.NewRecorder()
+	getCacheHandler(firstRR, firstReq)
+	etag := firstRR.Result().Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("want non-empty ETag")
+	}
+
+	req := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/noCacheKey", nil)
+	req.Header.Set("If-None-Match", etag)
+	req.Header.Set("Cache-Control", "no-cache")
+	rr := httptest.NewRecorder()
+	getCacheHandler(rr, req)
+	if rr.Result().StatusCode != 200 {
+		t.Errorf("want: 200; got: %d.\n\tno-cache should force revalidation instead of answering with a 304 shortcut.", rr.Result().StatusCode)
+	}
+}
+
 func TestGetStats(t *testing.T) {
 	t.Parallel()
 	var testStats bigcache.Stats
@@ -282,3 +458,216 @@ type errReader int
 func (errReader) Read([]byte) (int, error) {
 	return 0, errors.New("test read error")
 }
+
+func TestChunkedUploadRoundTrip(t *testing.T) {
+	t.Parallel()
+	testHandlers := cacheIndexHandler()
+
+	startReq := httptest.NewRequest("POST", testBaseString+"/api/v1/cache/uploadedKey/uploads", nil)
+	startRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(startRR, startReq)
+	startResp := startRR.Result()
+	if startResp.StatusCode != 202 {
+		t.Fatalf("want: 202; got: %d.\n\tcan't start an upload.", startResp.StatusCode)
+	}
+	location := startResp.Header.Get("Location")
+	if location == "" {
+		t.Fatal("want non-empty Location header naming the upload")
+	}
+
+	patchReq := httptest.NewRequest("PATCH", testBaseString+location, bytes.NewBuffer([]byte("hello chunked world")))
+	patchRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(patchRR, patchReq)
+	patchResp := patchRR.Result()
+	if patchResp.StatusCode != 202 {
+		t.Fatalf("want: 202; got: %d.\n\tcan't patch an upload.", patchResp.StatusCode)
+	}
+
+	finishReq := httptest.NewRequest("PUT", testBaseString+location, nil)
+	finishRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(finishRR, finishReq)
+	finishResp := finishRR.Result()
+	if finishResp.StatusCode != 201 {
+		t.Fatalf("want: 201; got: %d.\n\tcan't finish an upload.", finishResp.StatusCode)
+	}
+
+	getReq := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/uploadedKey", nil)
+	getRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(getRR, getReq)
+	getResp := getRR.Result()
+	if getResp.StatusCode != 200 {
+		t.Fatalf("want: 200; got: %d.\n\tcan't GET a chunked-upload entry.", getResp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(getResp.Body)
+	if err != nil {
+		t.Fatalf("cannot deserialise test response: %s", err)
+	}
+	if string(body) != "hello chunked world" {
+		t.Errorf("want: hello chunked world; got: %s", string(body))
+	}
+}
+
+// TestGetEntryJSONConditional guards against the typed-codec path
+// (negotiatedEntryCodec/serveEntry) silently dropping conditional-GET
+// support: the envelope differs from the raw-bytes representation, but
+// If-None-Match should still 304 against the same ETag.
+func TestGetEntryJSONConditional(t *testing.T) {
+	t.Parallel()
+
+	putReq := httptest.NewRequest("PUT", testBaseString+"/api/v1/cache/jsonEntryKey", bytes.NewBuffer([]byte("hello")))
+	putRR := httptest.NewRecorder()
+	putCacheHandler(putRR, putReq)
+	if putRR.Result().StatusCode != 201 {
+		t.Fatalf("want: 201; got: %d", putRR.Result().StatusCode)
+	}
+
+	getReq := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/jsonEntryKey", nil)
+	getReq.Header.Set("Accept", "application/json")
+	getRR := httptest.NewRecorder()
+	getCacheHandler(getRR, getReq)
+	getResp := getRR.Result()
+	if getResp.StatusCode != 200 {
+		t.Fatalf("want: 200; got: %d", getResp.StatusCode)
+	}
+	etag := getResp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("want non-empty ETag on a typed response")
+	}
+
+	conditionalReq := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/jsonEntryKey", nil)
+	conditionalReq.Header.Set("Accept", "application/json")
+	conditionalReq.Header.Set("If-None-Match", etag)
+	conditionalRR := httptest.NewRecorder()
+	getCacheHandler(conditionalRR, conditionalReq)
+	conditionalResp := conditionalRR.Result()
+	if conditionalResp.StatusCode != 304 {
+		t.Errorf("want: 304; got: %d.\n\ttyped GET responses should still honor If-None-Match.", conditionalResp.StatusCode)
+	}
+}
+
+// TestPatchUploadSerializesConcurrentWrites guards against two concurrent
+// PATCHes against the same upload (a client retry racing the original,
+// which the resumable upload protocol is meant to tolerate) interleaving
+// their writes into the shared temp file.
+func TestPatchUploadSerializesConcurrentWrites(t *testing.T) {
+	t.Parallel()
+	testHandlers := cacheIndexHandler()
+
+	startReq := httptest.NewRequest("POST", testBaseString+"/api/v1/cache/concurrentUploadKey/uploads", nil)
+	startRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(startRR, startReq)
+	location := startRR.Result().Header.Get("Location")
+
+	const concurrency = 10
+	var wg sync.WaitGroup
+	statuses := make([]int, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("PATCH", testBaseString+location, bytes.NewBuffer([]byte("0123456789")))
+			rr := httptest.NewRecorder()
+			testHandlers.ServeHTTP(rr, req)
+			statuses[i] = rr.Result().StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	for _, status := range statuses {
+		if status != 202 {
+			t.Errorf("want: 202; got: %d", status)
+		}
+	}
+
+	finishReq := httptest.NewRequest("PUT", testBaseString+location, nil)
+	finishRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(finishRR, finishReq)
+	if finishRR.Result().StatusCode != 201 {
+		t.Fatalf("want: 201; got: %d", finishRR.Result().StatusCode)
+	}
+
+	getReq := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/concurrentUploadKey", nil)
+	getRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(getRR, getReq)
+	body, err := ioutil.ReadAll(getRR.Result().Body)
+	if err != nil {
+		t.Fatalf("cannot deserialise test response: %s", err)
+	}
+	if len(body) != concurrency*10 {
+		t.Fatalf("want: %d bytes; got: %d", concurrency*10, len(body))
+	}
+	for i := 0; i < len(body); i += 10 {
+		if string(body[i:i+10]) != "0123456789" {
+			t.Fatalf("want every 10-byte chunk to be an intact \"0123456789\"; got: %q at offset %d.\n\tconcurrent PATCHes interleaved their writes.", body[i:i+10], i)
+		}
+	}
+}
+
+// TestReapExpiredUploads guards against an abandoned upload (started but
+// never PATCHed/PUT to completion) leaking its temp file and fd forever.
+func TestReapExpiredUploads(t *testing.T) {
+	startReq := httptest.NewRequest("POST", testBaseString+"/api/v1/cache/abandonedKey/uploads", nil)
+	startRR := httptest.NewRecorder()
+	cacheIndexHandler().ServeHTTP(startRR, startReq)
+	if startRR.Result().StatusCode != 202 {
+		t.Fatalf("want: 202; got: %d", startRR.Result().StatusCode)
+	}
+
+	location := startRR.Result().Header.Get("Location")
+	_, id, ok := parseUploadPath(strings.TrimPrefix(location, testBaseString))
+	if !ok {
+		t.Fatalf("couldn't parse upload id back out of Location %q", location)
+	}
+
+	uploadsMu.Lock()
+	up, tracked := uploads[id]
+	if tracked {
+		up.expiresAt = time.Now().Add(-time.Second)
+	}
+	uploadsMu.Unlock()
+	if !tracked {
+		t.Fatal("want upload to be tracked right after starting it")
+	}
+	tempPath := up.file.Name()
+
+	reapExpiredUploads()
+
+	if uploadExists(id) {
+		t.Error("want: upload reaped; got: still tracked")
+	}
+	if _, err := os.Stat(tempPath); !os.IsNotExist(err) {
+		t.Errorf("want: temp file removed; got: %v", err)
+	}
+}
+
+// TestLiteralUploadsKeyIsNotHijacked guards against a key that merely
+// contains "/uploads" in its name (as opposed to actually being an upload
+// sub-path) being misrouted away from ordinary GET/PUT.
+func TestLiteralUploadsKeyIsNotHijacked(t *testing.T) {
+	t.Parallel()
+	testHandlers := cacheIndexHandler()
+	literalKey := "foo/uploads/bar"
+
+	putReq := httptest.NewRequest("PUT", testBaseString+"/api/v1/cache/"+literalKey, bytes.NewBuffer([]byte("literal value")))
+	putRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(putRR, putReq)
+	putResp := putRR.Result()
+	if putResp.StatusCode != 201 {
+		t.Fatalf("want: 201; got: %d.\n\ta key containing \"/uploads\" should PUT normally.", putResp.StatusCode)
+	}
+
+	getReq := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/"+literalKey, nil)
+	getRR := httptest.NewRecorder()
+	testHandlers.ServeHTTP(getRR, getReq)
+	getResp := getRR.Result()
+	if getResp.StatusCode != 200 {
+		t.Fatalf("want: 200; got: %d.\n\ta key containing \"/uploads\" should GET normally.", getResp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(getResp.Body)
+	if err != nil {
+		t.Fatalf("cannot deserialise test response: %s", err)
+	}
+	if string(body) != "literal value" {
+		t.Errorf("want: literal value; got: %s", string(body))
+	}
+}
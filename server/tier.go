@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/allegro/bigcache/v3/server/tiered"
+)
+
+var tierDir = flag.String("tierDir", "", "Optional directory for a persistent L2 tier; when set, GETs fall back to it on an L1 miss and L1 evictions spill into it instead of being lost")
+
+// tier is non-nil when --tierDir is set; getValue/setValue/deleteValue
+// route through it instead of the plain in-memory cache in that case.
+var tier *tiered.Cache
+
+func setupTier(config bigcache.Config) error {
+	if *tierDir == "" {
+		return nil
+	}
+
+	t, err := tiered.Open(context.Background(), *tierDir, config)
+	if err != nil {
+		return err
+	}
+	tier = t
+	return nil
+}
+
+func getValue(key string) ([]byte, error) {
+	if tier != nil {
+		return tier.Get(key)
+	}
+	return cache.Get(key)
+}
+
+func setValue(key string, value []byte) error {
+	if tier != nil {
+		return tier.Set(key, value)
+	}
+	return cache.Set(key, value)
+}
+
+func deleteValue(key string) error {
+	if tier != nil {
+		return tier.Delete(key)
+	}
+	return cache.Delete(key)
+}
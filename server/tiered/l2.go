@@ -0,0 +1,289 @@
+package tiered
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// recordHeaderSize is the fixed-width header preceding every append-log
+// record: key length, value length, and expiry (unix seconds), 8 bytes each.
+const recordHeaderSize = 24
+
+// l2Record locates a value within its shard's log file.
+type l2Record struct {
+	offset int64
+	length int64
+	expiry time.Time
+}
+
+// l2Shard is one shard's append-only log plus the in-memory index recovered
+// from it, protected by its own mutex so shards don't contend with each
+// other.
+type l2Shard struct {
+	mu    sync.Mutex
+	file  *os.File
+	index map[string]l2Record
+}
+
+// l2 is the on-disk second tier: one l2Shard per L1 shard, so spilled
+// entries land in the same shard they came from.
+type l2 struct {
+	dir    string
+	shards []*l2Shard
+	mask   uint64
+}
+
+func newL2(dir string, shardCount int, lifeWindow time.Duration) (*l2, error) {
+	if shardCount <= 0 || shardCount&(shardCount-1) != 0 {
+		return nil, fmt.Errorf("tiered: shard count must be a power of two, got %d", shardCount)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	store := &l2{dir: dir, mask: uint64(shardCount - 1)}
+	for i := 0; i < shardCount; i++ {
+		shard, err := openL2Shard(filepath.Join(dir, fmt.Sprintf("shard-%d.log", i)))
+		if err != nil {
+			return nil, err
+		}
+		store.shards = append(store.shards, shard)
+	}
+	return store, nil
+}
+
+func openL2Shard(path string) (*l2Shard, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	shard := &l2Shard{file: file, index: make(map[string]l2Record)}
+	if err := shard.rebuildIndex(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return shard, nil
+}
+
+// rebuildIndex replays the append log to recover the in-memory index after
+// a restart. Later records for a key shadow earlier ones; a truncated
+// trailing record (e.g. from a crash mid-write) is silently dropped.
+func (s *l2Shard) rebuildIndex() error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(s.file)
+
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		offset += recordHeaderSize
+
+		keyLen := int64(binary.BigEndian.Uint64(header[0:8]))
+		valueLen := int64(binary.BigEndian.Uint64(header[8:16]))
+		expiryUnix := int64(binary.BigEndian.Uint64(header[16:24]))
+
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			break
+		}
+		offset += keyLen
+
+		valueOffset := offset
+		if _, err := reader.Discard(int(valueLen)); err != nil {
+			break
+		}
+		offset += valueLen
+
+		s.index[string(key)] = l2Record{offset: valueOffset, length: valueLen, expiry: time.Unix(expiryUnix, 0)}
+	}
+	return nil
+}
+
+func (s *l2Shard) append(key string, value []byte, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end, err := s.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if err := writeRecord(s.file, key, value, expiry); err != nil {
+		return err
+	}
+
+	s.index[key] = l2Record{offset: end + recordHeaderSize + int64(len(key)), length: int64(len(value)), expiry: expiry}
+	return nil
+}
+
+func writeRecord(w io.Writer, key string, value []byte, expiry time.Time) error {
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint64(header[0:8], uint64(len(key)))
+	binary.BigEndian.PutUint64(header[8:16], uint64(len(value)))
+	binary.BigEndian.PutUint64(header[16:24], uint64(expiry.Unix()))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(key)); err != nil {
+		return err
+	}
+	_, err := w.Write(value)
+	return err
+}
+
+func (s *l2Shard) get(key string) ([]byte, bool, error) {
+	// The lock is held through the ReadAt, not just the index lookup: compact
+	// rewrites the log at new offsets and swaps s.file/s.index under this
+	// same lock, so releasing it between the lookup and the read would let a
+	// concurrent compact invalidate record.offset out from under us, reading
+	// whatever now lives at that offset in the post-compact file.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if !record.expiry.IsZero() && time.Now().After(record.expiry) {
+		return nil, false, nil
+	}
+
+	value := make([]byte, record.length)
+	if _, err := s.file.ReadAt(value, record.offset); err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// delete drops key from the index and appends a tombstone (an empty value
+// already past its expiry), so rebuildIndex doesn't restore the key's
+// earlier record after a restart.
+func (s *l2Shard) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.index, key)
+	if _, err := s.file.Seek(0, io.SeekEnd); err == nil {
+		_ = writeRecord(s.file, key, nil, time.Unix(1, 0))
+	}
+}
+
+// compact rewrites the shard's log with only its live, unexpired records,
+// reclaiming the space held by overwritten or expired entries.
+func (s *l2Shard) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmpPath := s.file.Name() + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	newIndex := make(map[string]l2Record, len(s.index))
+	now := time.Now()
+	for key, record := range s.index {
+		if !record.expiry.IsZero() && now.After(record.expiry) {
+			continue
+		}
+
+		value := make([]byte, record.length)
+		if _, err := s.file.ReadAt(value, record.offset); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+
+		offset, err := tmp.Seek(0, io.SeekEnd)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := writeRecord(tmp, key, value, record.expiry); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+
+		newIndex[key] = l2Record{offset: offset + recordHeaderSize + int64(len(key)), length: record.length, expiry: record.expiry}
+	}
+
+	path := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// tmp.Name() still reports tmpPath after the rename, so reopen the log
+	// under its own path; the next compact derives its paths from s.file.
+	tmp.Close()
+	file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	s.file = file
+	s.index = newIndex
+	return nil
+}
+
+func (s *l2Shard) close() error {
+	return s.file.Close()
+}
+
+func (store *l2) shardFor(key string) *l2Shard {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return store.shards[h.Sum64()&store.mask]
+}
+
+func (store *l2) get(key string) ([]byte, bool, error) {
+	return store.shardFor(key).get(key)
+}
+
+func (store *l2) set(key string, value []byte, expiry time.Time) error {
+	return store.shardFor(key).append(key, value, expiry)
+}
+
+func (store *l2) delete(key string) {
+	store.shardFor(key).delete(key)
+}
+
+func (store *l2) compact() error {
+	for _, shard := range store.shards {
+		if err := shard.compact(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *l2) close() error {
+	var firstErr error
+	for _, shard := range store.shards {
+		if err := shard.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,117 @@
+// Package tiered implements a two-tier cache: an in-memory bigcache.BigCache
+// L1 backed by a persistent, file-based L2. Entries evicted from L1 (by
+// expiry or lack of space) spill into L2 instead of being lost, and GET
+// misses in L1 transparently promote the value back out of L2.
+package tiered
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+// Cache is a two-tier cache rooted at a directory on disk.
+type Cache struct {
+	l1            *bigcache.BigCache
+	l2            *l2
+	lifeWindow    time.Duration
+	stopCompactor chan struct{}
+}
+
+// Open creates or reopens a two-tier cache under dir, with l1Config
+// governing the in-memory tier. l1Config.OnRemove/OnRemoveWithReason are
+// overridden so L1 evictions are wired into L2; set either on the Config
+// you pass in and it will be ignored.
+func Open(ctx context.Context, dir string, l1Config bigcache.Config) (*Cache, error) {
+	l2Store, err := newL2(dir, l1Config.Shards, l1Config.LifeWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cache{l2: l2Store, lifeWindow: l1Config.LifeWindow}
+
+	l1Config.OnRemove = nil
+	l1Config.OnRemoveWithReason = func(key string, entry []byte, reason bigcache.RemoveReason) {
+		if reason == bigcache.Deleted {
+			c.l2.delete(key)
+			return
+		}
+		_ = c.l2.set(key, entry, time.Now().Add(c.lifeWindow))
+	}
+
+	l1, err := bigcache.New(ctx, l1Config)
+	if err != nil {
+		return nil, err
+	}
+	c.l1 = l1
+
+	c.stopCompactor = make(chan struct{})
+	go c.runCompactor()
+
+	return c, nil
+}
+
+// runCompactor periodically rewrites L2 segments to drop entries expired
+// per LifeWindow, reclaiming the space they held.
+func (c *Cache) runCompactor() {
+	ticker := time.NewTicker(c.lifeWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = c.l2.compact()
+		case <-c.stopCompactor:
+			return
+		}
+	}
+}
+
+// Get returns the value for key, promoting it from L2 into L1 on an L1
+// miss so subsequent reads are served from memory.
+func (c *Cache) Get(key string) ([]byte, error) {
+	value, err := c.l1.Get(key)
+	if err == nil {
+		return value, nil
+	}
+	if !errors.Is(err, bigcache.ErrEntryNotFound) {
+		return nil, err
+	}
+
+	value, ok, err := c.l2.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, bigcache.ErrEntryNotFound
+	}
+
+	_ = c.l1.Set(key, value)
+	return value, nil
+}
+
+// Set writes key through to both tiers, so the entry survives a restart
+// even before L1 ever evicts it.
+func (c *Cache) Set(key string, value []byte) error {
+	if err := c.l2.set(key, value, time.Now().Add(c.lifeWindow)); err != nil {
+		return err
+	}
+	return c.l1.Set(key, value)
+}
+
+// Delete removes key from both tiers.
+func (c *Cache) Delete(key string) error {
+	err := c.l1.Delete(key)
+	c.l2.delete(key)
+	if err != nil && !errors.Is(err, bigcache.ErrEntryNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Close stops the background compactor and closes the L2 segment files.
+func (c *Cache) Close() error {
+	close(c.stopCompactor)
+	return c.l2.close()
+}
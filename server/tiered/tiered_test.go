@@ -0,0 +1,53 @@
+package tiered
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+func testConfig() bigcache.Config {
+	return bigcache.Config{
+		Shards:             4,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 100,
+		MaxEntrySize:       500,
+		HardMaxCacheSize:   8,
+	}
+}
+
+// TestSetIsWriteThrough guards against Set relying solely on the
+// OnRemoveWithReason eviction callback to populate L2: a key that's never
+// evicted from L1 must still survive a process restart, since surviving a
+// restart is the entire point of a persistent L2.
+func TestSetIsWriteThrough(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := Open(context.Background(), dir, testConfig())
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	if err := cache.Set("key", []byte("value")); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	reopened, err := Open(context.Background(), dir, testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	defer reopened.Close()
+
+	value, err := reopened.Get("key")
+	if err != nil {
+		t.Fatalf("Get after reopen: %s", err)
+	}
+	if string(value) != "value" {
+		t.Errorf("want: value; got: %s", value)
+	}
+}
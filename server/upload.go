@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+// chunkIndex describes how a large entry was split across bigcache
+// sub-keys (<key>#0, <key>#1, ...) by the resumable upload protocol, so
+// contentReaderFor can reassemble it on GET.
+type chunkIndex struct {
+	ChunkCount int    `json:"chunkCount"`
+	ChunkSize  int64  `json:"chunkSize"`
+	Size       int64  `json:"size"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+// chunkReaderAt provides random access across an entry's chunk sub-keys
+// without reassembling it in memory up front, so ranged reads of a large
+// uploaded entry only ever touch the chunks the range actually covers.
+type chunkReaderAt struct {
+	key       string
+	chunkSize int64
+	size      int64
+}
+
+func (c *chunkReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= c.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for len(p) > 0 && off < c.size {
+		chunk, err := cache.Get(chunkKey(c.key, int(off/c.chunkSize)))
+		if err != nil {
+			return n, err
+		}
+
+		chunkOff := int(off % c.chunkSize)
+		if chunkOff >= len(chunk) {
+			return n, io.EOF
+		}
+
+		copied := copy(p, chunk[chunkOff:])
+		p = p[copied:]
+		off += int64(copied)
+		n += copied
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// contentReaderFor returns a seekable reader over the entry stored under
+// key, either a bytes.Reader over a plain value or a SectionReader over a
+// chunkReaderAt for entries written through the resumable upload protocol.
+func contentReaderFor(key string) (io.ReadSeeker, error) {
+	if value, err := getValue(key); err == nil {
+		return bytes.NewReader(value), nil
+	} else if !errors.Is(err, bigcache.ErrEntryNotFound) {
+		return nil, err
+	}
+
+	raw, err := chunkIndexCache.Get(key)
+	if err != nil {
+		return nil, bigcache.ErrEntryNotFound
+	}
+
+	var index chunkIndex
+	if err := json.Unmarshal(raw, &index); err != nil {
+		return nil, err
+	}
+
+	reader := &chunkReaderAt{key: key, chunkSize: index.ChunkSize, size: index.Size}
+	return io.NewSectionReader(reader, 0, index.Size), nil
+}
+
+// upload tracks an in-progress chunked PUT, backed by a temp file so a
+// client can push an entry larger than a single request body in pieces.
+type upload struct {
+	key  string
+	file *os.File
+
+	// mu serializes writes to file and updates to size, so a PATCH retry
+	// racing the original (which the resumable upload protocol is meant to
+	// tolerate) can't interleave writes into the same file.
+	mu   sync.Mutex
+	size int64
+
+	// expiresAt is pushed forward on every PATCH; an upload that sits past
+	// it without progress is considered abandoned and reaped.
+	expiresAt time.Time
+}
+
+// uploadExpiry bounds how long an in-progress upload may sit without a
+// PATCH before it's reaped. Without this, an abandoned or never-finished
+// upload (a dropped client, a crash, or just a POST that's never
+// followed up) would leak its temp file and fd forever.
+const uploadExpiry = time.Hour
+
+var (
+	uploadsMu sync.Mutex
+	uploads   = map[string]*upload{}
+)
+
+// reapExpiredUploads removes upload sessions that have gone past
+// uploadExpiry without a PATCH, closing and deleting their temp files.
+func reapExpiredUploads() {
+	now := time.Now()
+
+	uploadsMu.Lock()
+	var expired []*upload
+	for id, up := range uploads {
+		if now.After(up.expiresAt) {
+			expired = append(expired, up)
+			delete(uploads, id)
+		}
+	}
+	uploadsMu.Unlock()
+
+	for _, up := range expired {
+		up.file.Close()
+		os.Remove(up.file.Name())
+	}
+}
+
+// runUploadReaper periodically sweeps for abandoned uploads for the
+// lifetime of the process.
+func runUploadReaper() {
+	ticker := time.NewTicker(uploadExpiry / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		reapExpiredUploads()
+	}
+}
+
+func chunkKey(key string, n int) string {
+	return fmt.Sprintf("%s#%d", key, n)
+}
+
+func generateUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// parseUploadPath recognises "<key>/uploads" (start a new upload) and
+// "<key>/uploads/<id>" (append to or commit an in-progress one). The match
+// is anchored to the final one or two path segments, so "uploads" earlier
+// in a key (e.g. "a/uploads/b/c") isn't mistaken for an upload path. A key
+// such as "foo/uploads/bar" does match; isUploadRequest then decides
+// whether the request actually goes to the upload protocol.
+func parseUploadPath(urlPath string) (key, id string, ok bool) {
+	trimmed := strings.TrimPrefix(urlPath, apiV1CachePrefix)
+	segments := strings.Split(trimmed, "/")
+
+	if len(segments) >= 2 && segments[len(segments)-1] == "uploads" {
+		key = strings.Join(segments[:len(segments)-1], "/")
+		return key, "", key != ""
+	}
+	if len(segments) >= 3 && segments[len(segments)-2] == "uploads" {
+		key = strings.Join(segments[:len(segments)-2], "/")
+		return key, segments[len(segments)-1], key != ""
+	}
+	return "", "", false
+}
+
+// isUploadRequest reports whether a request whose path matched
+// parseUploadPath should actually be routed to the upload protocol for the
+// given method. POST and PATCH have no meaning for a plain key (the normal
+// handlers always 405 them), so any path shaped like an upload request is
+// unambiguous there. PUT is ambiguous — it both stores a plain key and
+// commits an upload — so it's only treated as an upload commit when id
+// names a session that's actually in progress; otherwise it falls through
+// to a normal PUT on the literal key. GET and DELETE never participate in
+// the upload protocol at all, so they always fall through.
+func isUploadRequest(method, id string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPatch:
+		return true
+	case http.MethodPut:
+		return id != "" && uploadExists(id)
+	default:
+		return false
+	}
+}
+
+func uploadExists(id string) bool {
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	_, ok := uploads[id]
+	return ok
+}
+
+func uploadIndexHandler(w http.ResponseWriter, req *http.Request, key, id string) {
+	switch {
+	case req.Method == http.MethodPost && id == "":
+		startUploadHandler(w, req, key)
+	case req.Method == http.MethodPatch && id != "":
+		patchUploadHandler(w, req, key, id)
+	case req.Method == http.MethodPut && id != "":
+		finishUploadHandler(w, req, key, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func startUploadHandler(w http.ResponseWriter, req *http.Request, key string) {
+	if key == "" {
+		http.Error(w, "key is empty", http.StatusBadRequest)
+		return
+	}
+
+	id, err := generateUploadID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	file, err := ioutil.TempFile("", "bigcache-upload-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uploadsMu.Lock()
+	uploads[id] = &upload{key: key, file: file, expiresAt: time.Now().Add(uploadExpiry)}
+	uploadsMu.Unlock()
+
+	w.Header().Set("Location", fmt.Sprintf("%s%s/uploads/%s", apiV1CachePrefix, key, id))
+	w.Header().Set("Range", "0-0")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// parseContentRange extracts the start offset from a "bytes start-end" or
+// "bytes start-end/total" Content-Range header.
+func parseContentRange(header string) (start int64, err error) {
+	header = strings.TrimPrefix(strings.TrimSpace(header), "bytes ")
+	if idx := strings.IndexByte(header, '/'); idx >= 0 {
+		header = header[:idx]
+	}
+	startPart, _, found := strings.Cut(header, "-")
+	if !found {
+		return 0, fmt.Errorf("malformed Content-Range: %q", header)
+	}
+	return strconv.ParseInt(startPart, 10, 64)
+}
+
+func patchUploadHandler(w http.ResponseWriter, req *http.Request, key, id string) {
+	uploadsMu.Lock()
+	up, ok := uploads[id]
+	uploadsMu.Unlock()
+	if !ok || up.key != key {
+		http.Error(w, "unknown upload", http.StatusNotFound)
+		return
+	}
+
+	// Hold up.mu for the whole read-check-write-update so a retried PATCH
+	// racing the original can't interleave its write into up.file with it.
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	if cr := req.Header.Get("Content-Range"); cr != "" {
+		start, err := parseContentRange(cr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if start != up.size {
+			http.Error(w, "chunk does not continue from the last byte received", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+
+	n, err := io.Copy(up.file, req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	up.size += n
+
+	uploadsMu.Lock()
+	up.expiresAt = time.Now().Add(uploadExpiry)
+	uploadsMu.Unlock()
+
+	w.Header().Set("Range", fmt.Sprintf("0-%d", up.size-1))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func finishUploadHandler(w http.ResponseWriter, req *http.Request, key, id string) {
+	uploadsMu.Lock()
+	up, ok := uploads[id]
+	delete(uploads, id)
+	uploadsMu.Unlock()
+	if !ok || up.key != key {
+		http.Error(w, "unknown upload", http.StatusNotFound)
+		return
+	}
+	defer os.Remove(up.file.Name())
+	defer up.file.Close()
+
+	// Removed from uploads above, so no new PATCH can reach it, but one
+	// already in flight could still be writing — wait for it to finish.
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	if _, err := up.file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	chunkSize := *maxEntrySize
+	if chunkSize <= 0 {
+		chunkSize = 1 << 20
+	}
+
+	hasher := sha256.New()
+	buf := make([]byte, chunkSize)
+	count := 0
+	for {
+		n, err := io.ReadFull(up.file, buf)
+		if n > 0 {
+			hasher.Write(buf[:n])
+			if setErr := cache.Set(chunkKey(key, count), append([]byte(nil), buf[:n]...)); setErr != nil {
+				http.Error(w, setErr.Error(), http.StatusInternalServerError)
+				return
+			}
+			count++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	digest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	if want := req.URL.Query().Get("digest"); want != "" && want != digest {
+		http.Error(w, "digest mismatch", http.StatusBadRequest)
+		return
+	}
+
+	index := chunkIndex{ChunkCount: count, ChunkSize: int64(chunkSize), Size: up.size, Digest: digest}
+	raw, err := json.Marshal(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := chunkIndexCache.Set(key, raw); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := setMetaWithETag(key, `"`+digest+`"`); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+}